@@ -2,11 +2,14 @@ package log
 
 import (
 	"bytes"
+	"encoding"
 	"encoding/json"
 	"fmt"
+	"math"
 	"reflect"
 	"runtime/debug"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -14,41 +17,179 @@ import (
 // in production because it is machine parseable.
 type JSONFormatter struct {
 	name string
+
+	// ReplaceAttr, if set, is called for every key/value pair written by
+	// Format -- including the reserved _t, _l, _n and _m fields -- before
+	// it is appended to the buffer. Returning an empty key drops the
+	// attribute entirely; otherwise the returned key and value are the
+	// ones written. groups is the WithGroup nesting path the attribute is
+	// being written under; it's always empty for the reserved fields,
+	// which are never grouped.
+	ReplaceAttr func(groups []string, key string, value interface{}) (string, interface{})
+
+	// TimeFormat controls how the _t field is rendered. It defaults to
+	// timeFormat. Set it to TimeFormatUnixMillis to emit a numeric,
+	// unquoted Unix epoch-milliseconds value instead, or to any other
+	// time.Format layout (e.g. time.RFC3339Nano) to change the string
+	// representation.
+	TimeFormat string
+
+	// NowFunc, if set, is used instead of time.Now to obtain the
+	// timestamp for the _t field. This makes Format's output
+	// deterministic in tests.
+	NowFunc func() time.Time
+
+	// groups is the stack of names opened by WithGroup. Reserved fields
+	// (_t, _l, _n, _m) always stay at the top level; every other
+	// key/value pair passed to Format is nested under groups as
+	// {"groups[0]":{"groups[1]":{...}}}.
+	groups []string
 }
 
+// WithGroup returns a copy of jf that nests all subsequent non-reserved
+// key/value pairs under a JSON object named name, e.g.
+// WithGroup("http") turns args "method", "GET", "status", 200 into
+// {"http":{"method":"GET","status":200}}. Groups nest: calling WithGroup
+// again on the result opens a further sub-object. ReplaceAttr, if set,
+// receives the full group path for each attribute.
+func (jf *JSONFormatter) WithGroup(name string) *JSONFormatter {
+	clone := *jf
+	clone.groups = append(append([]string{}, jf.groups...), name)
+	return &clone
+}
+
+// pooledEncoder pairs a *json.Encoder with the buffer it writes into, so
+// both can be reused across calls to appendValue instead of allocating a
+// fresh encoder and output buffer for every struct/map/slice value.
+type pooledEncoder struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+}
+
+var encoderPool = sync.Pool{
+	New: func() interface{} {
+		pe := &pooledEncoder{}
+		pe.enc = json.NewEncoder(&pe.buf)
+		return pe
+	},
+}
+
+// TimeFormatUnixMillis is a sentinel TimeFormat value that makes the _t
+// field a numeric Unix epoch-milliseconds value instead of a quoted
+// timestamp string.
+const TimeFormatUnixMillis = "unix_millis"
+
 // NewJSONFormatter creates a new instance of JSONFormatter.
 func NewJSONFormatter(name string) *JSONFormatter {
 	return &JSONFormatter{name: name}
 }
 
+// jsonSafeByte reports whether c can be copied verbatim into a JSON string,
+// i.e. it needs no quoting, escaping or UTF-8 decoding.
+func jsonSafeByte(c byte) bool {
+	return c >= 0x20 && c != '"' && c != '\\' && c < 0x80
+}
+
+// writeFloat writes f as a JSON number. NaN and +/-Inf have no JSON
+// representation, so they're written as the quoted strings "NaN",
+// "Infinity" and "-Infinity" instead.
+func (jf *JSONFormatter) writeFloat(buf *bytes.Buffer, f float64, bitSize int) {
+	switch {
+	case math.IsNaN(f):
+		buf.WriteString(`"NaN"`)
+	case math.IsInf(f, 1):
+		buf.WriteString(`"Infinity"`)
+	case math.IsInf(f, -1):
+		buf.WriteString(`"-Infinity"`)
+	default:
+		var scratch [32]byte
+		buf.Write(strconv.AppendFloat(scratch[:0], f, 'g', -1, bitSize))
+	}
+}
+
+// writeString writes s as a JSON string. The common case -- a plain-ASCII
+// string with no characters requiring escaping -- is written straight into
+// buf with no intermediate allocation; anything else, including any string
+// with a byte >= 0x80, falls back to json.Marshal, which
+// also sanitizes invalid UTF-8 by substituting U+FFFD, so Format's output is
+// always parseable JSON even for malformed input.
 func (jf *JSONFormatter) writeString(buf *bytes.Buffer, s string) {
-	b, err := json.Marshal(s)
-	if err != nil {
-		InternalLog.Error("Could not json.Marshal string.", "str", s)
-		buf.WriteString(`"Could not marshal this key's string"`)
-		return
+	for i := 0; i < len(s); i++ {
+		if !jsonSafeByte(s[i]) {
+			b, err := json.Marshal(s)
+			if err != nil {
+				InternalLog.Error("Could not json.Marshal string.", "str", s)
+				buf.WriteString(`"Could not marshal this key's string"`)
+				return
+			}
+			buf.Write(b)
+			return
+		}
 	}
-	buf.Write(b)
+	buf.WriteByte('"')
+	buf.WriteString(s)
+	buf.WriteByte('"')
 }
 
-func (jf *JSONFormatter) writeError(buf *bytes.Buffer, err error) {
+func (jf *JSONFormatter) writeError(buf *bytes.Buffer, firstKey *bool, err error) {
 	jf.writeString(buf, err.Error())
-	jf.set(buf, callstackKey, string(debug.Stack()))
+	jf.set(buf, firstKey, jf.groups, callstackKey, string(debug.Stack()))
 	return
 }
 
-func (jf *JSONFormatter) appendValue(buf *bytes.Buffer, val interface{}) {
+func (jf *JSONFormatter) appendValue(buf *bytes.Buffer, firstKey *bool, val interface{}) {
 	if val == nil {
 		buf.WriteString("null")
 		return
 	}
 
-	value := reflect.ValueOf(val)
+	// A nil pointer can still satisfy json.Marshaler/encoding.TextMarshaler
+	// via a pointer receiver; calling the method would panic the moment it
+	// dereferences the receiver, so check for that before invoking it.
+	rv := reflect.ValueOf(val)
+	isNilPtr := rv.Kind() == reflect.Ptr && rv.IsNil()
+
+	if m, ok := val.(json.Marshaler); ok {
+		if isNilPtr {
+			buf.WriteString("null")
+			return
+		}
+		b, err := m.MarshalJSON()
+		if err != nil {
+			InternalLog.Error("Could not MarshalJSON value.", "formatter", "JSONFormatter", "err", err.Error())
+			buf.WriteString(`"Could not marshal this key's value"`)
+			return
+		}
+		buf.Write(b)
+		return
+	}
+
+	if m, ok := val.(encoding.TextMarshaler); ok {
+		if isNilPtr {
+			buf.WriteString("null")
+			return
+		}
+		b, err := m.MarshalText()
+		if err != nil {
+			InternalLog.Error("Could not MarshalText value.", "formatter", "JSONFormatter", "err", err.Error())
+			buf.WriteString(`"Could not marshal this key's value"`)
+			return
+		}
+		jf.writeString(buf, string(b))
+		return
+	}
+
+	value := rv
 	kind := value.Kind()
 	if kind == reflect.Ptr {
 		value = value.Elem()
 		kind = value.Kind()
 	}
+	if kind == reflect.Invalid {
+		// val was a nil pointer; value.Interface() below would panic.
+		buf.WriteString("null")
+		return
+	}
 	switch kind {
 	case reflect.Bool:
 		if value.Bool() {
@@ -57,65 +198,111 @@ func (jf *JSONFormatter) appendValue(buf *bytes.Buffer, val interface{}) {
 			buf.WriteString("false")
 		}
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		buf.WriteString(strconv.FormatInt(value.Int(), 10))
+		var scratch [20]byte
+		buf.Write(strconv.AppendInt(scratch[:0], value.Int(), 10))
 
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
-		buf.WriteString(strconv.FormatUint(value.Uint(), 10))
+		var scratch [20]byte
+		buf.Write(strconv.AppendUint(scratch[:0], value.Uint(), 10))
 
 	case reflect.Float32:
-		buf.WriteString(strconv.FormatFloat(value.Float(), 'g', -1, 32))
+		jf.writeFloat(buf, value.Float(), 32)
 
 	case reflect.Float64:
-		buf.WriteString(strconv.FormatFloat(value.Float(), 'g', -1, 64))
+		jf.writeFloat(buf, value.Float(), 64)
+
+	case reflect.String:
+		jf.writeString(buf, value.String())
 
 	default:
 		if err, ok := val.(error); ok {
-			jf.writeError(buf, err)
+			jf.writeError(buf, firstKey, err)
 			return
 		}
 
-		b, err := json.Marshal(value.Interface())
+		pe := encoderPool.Get().(*pooledEncoder)
+		pe.buf.Reset()
+		err := pe.enc.Encode(value.Interface())
 		if err != nil {
 			InternalLog.Error("Could not json.Marshal value: ", "formatter", "JSONFormatter", "err", err.Error())
 			// must always log, use sprintf to get a string
 			s := fmt.Sprintf("%#v", value.Interface())
-			b, err = json.Marshal(s)
-			if err != nil {
-				// should never get here, but JSONFormatter should never panic
-				msg := "Could not Sprintf value"
-				InternalLog.Error(msg)
-				buf.WriteString(`"` + msg + `"`)
-				return
-			}
+			jf.writeString(buf, s)
+			encoderPool.Put(pe)
+			return
 		}
-		buf.Write(b)
+		// Encoder always appends a trailing newline; drop it.
+		buf.Write(bytes.TrimRight(pe.buf.Bytes(), "\n"))
+		encoderPool.Put(pe)
 	}
 }
 
-func (jf *JSONFormatter) set(buf *bytes.Buffer, key string, val interface{}) {
-	// WARNING: assumes this is not first key
-	buf.WriteString(`, "`)
+// set writes key/val through ReplaceAttr (if set) before appending it to
+// buf. groups is the current WithGroup nesting path. An empty key after
+// replacement drops the attribute. firstKey tracks whether this is the
+// first field written to the enclosing object, so set can be composed as
+// a general emitter instead of assuming a leading comma is always needed.
+func (jf *JSONFormatter) set(buf *bytes.Buffer, firstKey *bool, groups []string, key string, val interface{}) {
+	if jf.ReplaceAttr != nil {
+		key, val = jf.ReplaceAttr(groups, key, val)
+		if key == "" {
+			return
+		}
+	}
+	if *firstKey {
+		buf.WriteByte('"')
+		*firstKey = false
+	} else {
+		buf.WriteString(`, "`)
+	}
 	buf.WriteString(key)
 	buf.WriteString(`":`)
-	jf.appendValue(buf, val)
+	jf.appendValue(buf, firstKey, val)
+}
+
+// openGroup writes name as a key, like set, then opens its JSON object.
+// Unlike set, the value isn't known up front -- it's whatever gets
+// written between here and the matching close written by Format.
+func (jf *JSONFormatter) openGroup(buf *bytes.Buffer, firstKey *bool, name string) {
+	if *firstKey {
+		buf.WriteByte('"')
+		*firstKey = false
+	} else {
+		buf.WriteString(`, "`)
+	}
+	buf.WriteString(name)
+	buf.WriteString(`":{`)
 }
 
 // Format formats log entry as JSON.
 func (jf *JSONFormatter) Format(buf *bytes.Buffer, level int, msg string, args []interface{}) {
-	buf.WriteString(`{"_t":"`)
-	buf.WriteString(time.Now().Format(timeFormat))
-	buf.WriteRune('"')
+	now := time.Now()
+	if jf.NowFunc != nil {
+		now = jf.NowFunc()
+	}
+
+	var ts interface{}
+	switch jf.TimeFormat {
+	case TimeFormatUnixMillis:
+		ts = now.UnixNano() / int64(time.Millisecond)
+	case "":
+		ts = now.Format(timeFormat)
+	default:
+		ts = now.Format(jf.TimeFormat)
+	}
 
-	buf.WriteString(`, "_l":"`)
-	buf.WriteString(LevelMap[level])
-	buf.WriteRune('"')
+	firstKey := true
 
-	buf.WriteString(`, "_n":"`)
-	buf.WriteString(jf.name)
-	buf.WriteRune('"')
+	buf.WriteByte('{')
+	jf.set(buf, &firstKey, nil, "_t", ts)
+	jf.set(buf, &firstKey, nil, "_l", LevelMap[level])
+	jf.set(buf, &firstKey, nil, "_n", jf.name)
+	jf.set(buf, &firstKey, nil, "_m", msg)
 
-	buf.WriteString(`, "_m":`)
-	jf.appendValue(buf, msg)
+	for _, name := range jf.groups {
+		jf.openGroup(buf, &firstKey, name)
+		firstKey = true
+	}
 
 	var lenArgs = len(args)
 	if lenArgs > 0 {
@@ -124,19 +311,23 @@ func (jf *JSONFormatter) Format(buf *bytes.Buffer, level int, msg string, args [
 				if key, ok := args[i].(string); ok {
 					if key == "" {
 						// show key is invalid
-						jf.set(buf, badKeyAtIndex(i), args[i+1])
+						jf.set(buf, &firstKey, jf.groups, badKeyAtIndex(i), args[i+1])
 					} else {
-						jf.set(buf, key, args[i+1])
+						jf.set(buf, &firstKey, jf.groups, key, args[i+1])
 					}
 				} else {
 					// show key is invalid
-					jf.set(buf, badKeyAtIndex(i), args[i+1])
+					jf.set(buf, &firstKey, jf.groups, badKeyAtIndex(i), args[i+1])
 				}
 			}
 		} else {
-			jf.set(buf, warnImbalancedKey, args)
+			jf.set(buf, &firstKey, jf.groups, warnImbalancedKey, args)
 		}
 	}
+
+	for range jf.groups {
+		buf.WriteByte('}')
+	}
 	buf.WriteString("}\n")
 }
 
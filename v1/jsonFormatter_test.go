@@ -0,0 +1,232 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONFormatterReplaceAttrDropsFirstField(t *testing.T) {
+	jf := NewJSONFormatter("test")
+	jf.ReplaceAttr = func(groups []string, key string, value interface{}) (string, interface{}) {
+		if key == "_t" {
+			return "", nil
+		}
+		return key, value
+	}
+
+	var buf bytes.Buffer
+	jf.Format(&buf, 0, "hi", nil)
+
+	if strings.Contains(buf.String(), "_t") {
+		t.Fatalf("expected _t to be dropped, got %q", buf.String())
+	}
+	if strings.HasPrefix(buf.String(), `{, "`) {
+		t.Fatalf("dropping the first field left a stray leading comma: %q", buf.String())
+	}
+}
+
+func TestJSONFormatterReplaceAttrRenamesAndRedacts(t *testing.T) {
+	jf := NewJSONFormatter("test")
+	jf.ReplaceAttr = func(groups []string, key string, value interface{}) (string, interface{}) {
+		switch key {
+		case "_t":
+			return "timestamp", value
+		case "password":
+			return key, "***"
+		}
+		return key, value
+	}
+
+	entry := jf.LogEntry(0, "hi", []interface{}{"password", "hunter2"})
+	if _, ok := entry["_t"]; ok {
+		t.Fatalf("expected _t to be renamed away, got entry %v", entry)
+	}
+	if entry["timestamp"] == nil {
+		t.Fatalf("expected renamed timestamp field, got entry %v", entry)
+	}
+	if entry["password"] != "***" {
+		t.Fatalf("expected password to be redacted, got %v", entry["password"])
+	}
+}
+
+func TestJSONFormatterWithGroupNesting(t *testing.T) {
+	jf := NewJSONFormatter("test").WithGroup("http").WithGroup("req")
+
+	entry := jf.LogEntry(0, "hi", []interface{}{"method", "GET", "status", 200})
+	http, ok := entry["http"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected nested http object, got entry %v", entry)
+	}
+	req, ok := http["req"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected nested http.req object, got %v", http)
+	}
+	if req["method"] != "GET" {
+		t.Fatalf("expected method GET, got %v", req)
+	}
+	if entry["method"] != nil {
+		t.Fatalf("expected method to be nested, not top-level: %v", entry)
+	}
+}
+
+func TestJSONFormatterWithGroupReplaceAttrDrop(t *testing.T) {
+	jf := NewJSONFormatter("test").WithGroup("http")
+	jf.ReplaceAttr = func(groups []string, key string, value interface{}) (string, interface{}) {
+		if key == "method" {
+			return "", nil
+		}
+		return key, value
+	}
+
+	entry := jf.LogEntry(0, "hi", []interface{}{"method", "GET", "status", 200})
+	http, ok := entry["http"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected nested http object, got entry %v", entry)
+	}
+	if _, ok := http["method"]; ok {
+		t.Fatalf("expected method to be dropped, got %v", http)
+	}
+	if http["status"] != float64(200) {
+		t.Fatalf("expected status 200 to survive the drop, got %v", http)
+	}
+}
+
+func TestJSONFormatterTimeFormatUnixMillis(t *testing.T) {
+	jf := NewJSONFormatter("test")
+	jf.TimeFormat = TimeFormatUnixMillis
+	jf.NowFunc = func() time.Time {
+		return time.Unix(0, 1234567890*int64(time.Millisecond))
+	}
+
+	var buf bytes.Buffer
+	jf.Format(&buf, 0, "hi", nil)
+
+	if !strings.Contains(buf.String(), `"_t":1234567890,`) {
+		t.Fatalf("expected unquoted millis timestamp, got %q", buf.String())
+	}
+}
+
+func TestJSONFormatterNaNInfAndInvalidUTF8(t *testing.T) {
+	jf := NewJSONFormatter("test")
+
+	entry := jf.LogEntry(0, "hi", []interface{}{
+		"nan", math.NaN(),
+		"inf", math.Inf(1),
+		"neginf", math.Inf(-1),
+		"bad", "abc\xffdef",
+	})
+
+	if entry["nan"] != "NaN" {
+		t.Fatalf("expected NaN to be quoted, got %v", entry["nan"])
+	}
+	if entry["inf"] != "Infinity" {
+		t.Fatalf("expected +Inf to be quoted, got %v", entry["inf"])
+	}
+	if entry["neginf"] != "-Infinity" {
+		t.Fatalf("expected -Inf to be quoted, got %v", entry["neginf"])
+	}
+	if !strings.Contains(entry["bad"].(string), "abc") {
+		t.Fatalf("expected invalid UTF-8 to be sanitized rather than dropped, got %v", entry["bad"])
+	}
+}
+
+func TestJSONFormatterNilPointerDoesNotPanic(t *testing.T) {
+	jf := NewJSONFormatter("test")
+	var p *int
+
+	var buf bytes.Buffer
+	jf.Format(&buf, 0, "hi", []interface{}{"p", p})
+
+	entry := jf.LogEntry(0, "hi", []interface{}{"p", p})
+	if entry["p"] != nil {
+		t.Fatalf("expected nil pointer to serialize as null, got %v", entry["p"])
+	}
+}
+
+func TestJSONFormatterErrorValue(t *testing.T) {
+	jf := NewJSONFormatter("test")
+
+	entry := jf.LogEntry(0, "hi", []interface{}{"err", errors.New("boom")})
+	if entry["err"] != "boom" {
+		t.Fatalf("expected error message, got %v", entry["err"])
+	}
+	if entry[callstackKey] == nil {
+		t.Fatalf("expected callstack key to be set, got entry %v", entry)
+	}
+}
+
+// jsonMarshaler implements json.Marshaler with a pointer receiver, mirroring
+// slog's TestJSONHandler jsonMarshaler case.
+type jsonMarshaler struct {
+	s string
+}
+
+func (m *jsonMarshaler) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + m.s + `-json"`), nil
+}
+
+type failingMarshaler struct{}
+
+func (failingMarshaler) MarshalJSON() ([]byte, error) {
+	return nil, errors.New("boom")
+}
+
+type textMarshaler struct {
+	s string
+}
+
+func (m *textMarshaler) MarshalText() ([]byte, error) {
+	return []byte(m.s + "-text"), nil
+}
+
+func TestJSONFormatterJSONMarshaler(t *testing.T) {
+	jf := NewJSONFormatter("test")
+
+	entry := jf.LogEntry(0, "hi", []interface{}{"v", &jsonMarshaler{s: "hello"}})
+	if entry["v"] != "hello-json" {
+		t.Fatalf("expected MarshalJSON output, got %v", entry["v"])
+	}
+}
+
+func TestJSONFormatterJSONMarshalerError(t *testing.T) {
+	jf := NewJSONFormatter("test")
+
+	var buf bytes.Buffer
+	jf.Format(&buf, 0, "hi", []interface{}{"v", failingMarshaler{}})
+	if !strings.Contains(buf.String(), "Could not marshal this key's value") {
+		t.Fatalf("expected marshal-error placeholder, got %q", buf.String())
+	}
+}
+
+func TestJSONFormatterTextMarshaler(t *testing.T) {
+	jf := NewJSONFormatter("test")
+
+	entry := jf.LogEntry(0, "hi", []interface{}{"v", &textMarshaler{s: "hello"}})
+	if entry["v"] != "hello-text" {
+		t.Fatalf("expected MarshalText output, got %v", entry["v"])
+	}
+}
+
+func TestJSONFormatterNilJSONMarshalerDoesNotPanic(t *testing.T) {
+	jf := NewJSONFormatter("test")
+	var m *jsonMarshaler
+
+	entry := jf.LogEntry(0, "hi", []interface{}{"v", m})
+	if entry["v"] != nil {
+		t.Fatalf("expected nil Marshaler to serialize as null, got %v", entry["v"])
+	}
+}
+
+func TestJSONFormatterNilTextMarshalerDoesNotPanic(t *testing.T) {
+	jf := NewJSONFormatter("test")
+	var m *textMarshaler
+
+	entry := jf.LogEntry(0, "hi", []interface{}{"v", m})
+	if entry["v"] != nil {
+		t.Fatalf("expected nil TextMarshaler to serialize as null, got %v", entry["v"])
+	}
+}